@@ -6,8 +6,10 @@ package libkbfs
 
 import (
 	"container/heap"
+	"fmt"
 	"io"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -15,8 +17,325 @@ import (
 const (
 	defaultBlockRetrievalWorkerQueueSize int = 100
 	defaultOnDemandRequestPriority       int = 100
+
+	// defaultRetrievalTimeout is how long a retrieval may sit with a worker
+	// before the supervisor assumes the worker is dead (or wedged) and
+	// cancels and retries it.
+	defaultRetrievalTimeout = 30 * time.Second
+	// onDemandRetrievalTimeout is the (shorter) deadline given to retrievals
+	// at defaultOnDemandRequestPriority or above, since those are usually
+	// blocking an interactive user request.
+	onDemandRetrievalTimeout = 10 * time.Second
+	// retrievalSupervisorInterval is how often the supervisor scans
+	// in-flight retrievals for ones that have exceeded their deadline.
+	retrievalSupervisorInterval = 5 * time.Second
+	// maxRetrievalRetries bounds how many times a retrieval can be bounced
+	// back to the queue after timing out before we give up on it.
+	maxRetrievalRetries = 3
+	// defaultFinishedRetrievalCacheSize is how many recently-completed
+	// blocks the queue remembers by default; see finishedRetrievalCache.
+	defaultFinishedRetrievalCacheSize = 256
 )
 
+// BlockRetrievalTimeout is the error retryOrFail delivers to a retrieval's
+// requests when the retrieval exceeds its deadline again after already
+// having been retried maxRetrievalRetries times, and the queue gives up on
+// it.
+type BlockRetrievalTimeout struct {
+	Ptr BlockPointer
+}
+
+// Error implements the error interface.
+func (e BlockRetrievalTimeout) Error() string {
+	return fmt.Sprintf(
+		"block retrieval for %s timed out after %d retries",
+		e.Ptr, maxRetrievalRetries)
+}
+
+// QueueLimits bounds how much work a blockRetrievalQueue will admit
+// concurrently, so that a burst of large or numerous requests can't starve
+// latency-sensitive traffic. A zero value for any field means that
+// particular limit is disabled. Requests at or above
+// defaultOnDemandRequestPriority always bypass these limits: an on-demand
+// user read should never queue up behind a saturated background prefetch.
+type QueueLimits struct {
+	// MaxInFlight is the maximum number of retrievals that may be admitted
+	// (queued or in progress) at once.
+	MaxInFlight int
+	// MaxInFlightBytes is the maximum total estimated size, in bytes, of
+	// admitted retrievals.
+	MaxInFlightBytes int64
+	// ExpensiveThresholdBytes is the estimated block size, in bytes, at or
+	// above which a retrieval counts against MaxExpensiveInFlight.
+	ExpensiveThresholdBytes int64
+	// MaxExpensiveInFlight is the maximum number of expensive retrievals
+	// that may be admitted at once.
+	MaxExpensiveInFlight int
+}
+
+// QueueMetrics is a point-in-time snapshot of a blockRetrievalQueue's
+// admission-control and finished-retrieval-cache counters, suitable for
+// exporting to a metrics system.
+type QueueMetrics struct {
+	RequestsAdmitted  uint64
+	RequestsThrottled uint64
+	BytesInFlight     int64
+	CacheHits         uint64
+	CacheMisses       uint64
+}
+
+// admissionController gates how many retrievals (and bytes) are allowed
+// in flight at once, per QueueLimits. Requests that don't fit block until
+// capacity frees up or their context is canceled.
+type admissionController struct {
+	limits QueueLimits
+	// done is closed when the owning blockRetrievalQueue is shut down, so
+	// admit can wake up and give up even when the caller's own ctx never
+	// will.
+	done <-chan struct{}
+
+	mu                sync.Mutex
+	inFlight          int
+	inFlightBytes     int64
+	expensiveInFlight int
+	admitted          uint64
+	throttled         uint64
+	// waiters are closed (and cleared) whenever capacity is released, so
+	// blocked admit calls wake up and recheck whether they now fit.
+	waiters []chan struct{}
+}
+
+func (a *admissionController) isExpensive(sizeBytes int64) bool {
+	return a.limits.ExpensiveThresholdBytes > 0 &&
+		sizeBytes >= a.limits.ExpensiveThresholdBytes
+}
+
+// fits reports whether a retrieval of sizeBytes can be admitted right now.
+// a.mu must be held.
+func (a *admissionController) fits(sizeBytes int64, expensive bool) bool {
+	if a.limits.MaxInFlight > 0 && a.inFlight >= a.limits.MaxInFlight {
+		return false
+	}
+	if a.limits.MaxInFlightBytes > 0 &&
+		a.inFlightBytes+sizeBytes > a.limits.MaxInFlightBytes {
+		return false
+	}
+	if expensive && a.limits.MaxExpensiveInFlight > 0 &&
+		a.expensiveInFlight >= a.limits.MaxExpensiveInFlight {
+		return false
+	}
+	return true
+}
+
+// admit blocks, respecting ctx, until a retrieval of sizeBytes can be
+// admitted, then reserves its tokens. Priorities at or above
+// defaultOnDemandRequestPriority always preempt: they're admitted (and
+// counted) immediately, never throttled. If the owning queue is shut down
+// while this call is waiting, it gives up with io.EOF even if ctx is never
+// canceled, so a Request caller can't be left blocked forever on capacity
+// that a now-stopped supervisor will never free.
+func (a *admissionController) admit(
+	ctx context.Context, priority int, sizeBytes int64, expensive bool) error {
+	onDemand := priority >= defaultOnDemandRequestPriority
+	for {
+		a.mu.Lock()
+		if onDemand || a.fits(sizeBytes, expensive) {
+			a.inFlight++
+			a.inFlightBytes += sizeBytes
+			if expensive {
+				a.expensiveInFlight++
+			}
+			a.admitted++
+			a.mu.Unlock()
+			return nil
+		}
+		a.throttled++
+		wait := make(chan struct{})
+		a.waiters = append(a.waiters, wait)
+		a.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-a.done:
+			return io.EOF
+		}
+	}
+}
+
+// release gives back the tokens reserved by a matching call to admit.
+func (a *admissionController) release(sizeBytes int64, expensive bool) {
+	a.mu.Lock()
+	a.inFlight--
+	a.inFlightBytes -= sizeBytes
+	if expensive {
+		a.expensiveInFlight--
+	}
+	waiters := a.waiters
+	a.waiters = nil
+	a.mu.Unlock()
+
+	for _, w := range waiters {
+		close(w)
+	}
+}
+
+func (a *admissionController) metrics() QueueMetrics {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return QueueMetrics{
+		RequestsAdmitted:  a.admitted,
+		RequestsThrottled: a.throttled,
+		BytesInFlight:     a.inFlightBytes,
+	}
+}
+
+// estimatedBlockSize returns the best guess at a block's on-the-wire size
+// without having fetched it yet, for admission-control purposes.
+func estimatedBlockSize(ptr BlockPointer) int64 {
+	return int64(ptr.EncodedSize)
+}
+
+// cachedBlock is one entry in a finishedRetrievalCache.
+type cachedBlock struct {
+	kmd   KeyMetadata
+	block Block
+}
+
+// finishedRetrievalCache is a small FIFO cache of recently-completed block
+// retrievals, scoped to a single blockRetrievalQueue. It lets a repeat
+// Request for a block that was *just* fetched skip decryption and worker
+// scheduling entirely. This is distinct from (and sits in front of) the
+// lifetime block cache: it survives the eviction races that can happen
+// during bursty read-amplifying workloads, e.g. a simultaneous
+// ReadDir+Stat touching the same blocks.
+type finishedRetrievalCache struct {
+	maxSize int
+
+	mu      sync.RWMutex
+	entries map[BlockPointer]cachedBlock
+	order   []BlockPointer
+
+	hits   uint64
+	misses uint64
+}
+
+func newFinishedRetrievalCache(maxSize int) *finishedRetrievalCache {
+	return &finishedRetrievalCache{
+		maxSize: maxSize,
+		entries: make(map[BlockPointer]cachedBlock),
+	}
+}
+
+// get returns the cached block for ptr, provided kmd has the same TLF ID as
+// the KeyMetadata it was cached under. No other part of the KeyMetadata is
+// compared.
+func (c *finishedRetrievalCache) get(
+	ptr BlockPointer, kmd KeyMetadata) (Block, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cached, ok := c.entries[ptr]
+	if !ok || cached.kmd.TlfID() != kmd.TlfID() {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	return cached.block, true
+}
+
+func (c *finishedRetrievalCache) put(
+	ptr BlockPointer, kmd KeyMetadata, block Block) {
+	if c.maxSize <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[ptr]; !exists {
+		c.order = append(c.order, ptr)
+	}
+	c.entries[ptr] = cachedBlock{kmd: kmd, block: block}
+	for len(c.order) > c.maxSize {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		delete(c.entries, oldest)
+	}
+}
+
+// purge removes ptr from the cache, if present, so a stale copy can't be
+// served to a future Request.
+func (c *finishedRetrievalCache) purge(ptr BlockPointer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[ptr]; !ok {
+		return
+	}
+	delete(c.entries, ptr)
+	for i, p := range c.order {
+		if p == ptr {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (c *finishedRetrievalCache) metrics() (hits, misses uint64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.hits, c.misses
+}
+
+// FairnessKey groups retrievals for fair scheduling within a priority band,
+// so that one key (e.g. a TLF doing a large prefetch) can't starve another
+// key's requests at the same priority for long. Request defaults this to
+// the request's TLF ID when the caller doesn't supply one.
+type FairnessKey string
+
+// fairScheduler picks which FairnessKey to serve next within a priority
+// band, in round-robin order, so each key that's currently active gets a
+// proportional share of that band's dispatches.
+type fairScheduler struct {
+	mu sync.Mutex
+	// lastServed tracks, per priority band, the round-robin counter value
+	// each key was last served at. Of the keys present in a band, the one
+	// with the lowest value is served next.
+	lastServed map[int]map[FairnessKey]uint64
+	tick       uint64
+}
+
+func newFairScheduler() *fairScheduler {
+	return &fairScheduler{lastServed: make(map[int]map[FairnessKey]uint64)}
+}
+
+// next picks, among candidates (all assumed to share the same priority),
+// the one belonging to the least-recently-served FairnessKey, breaking ties
+// by insertion order.
+func (f *fairScheduler) next(
+	priority int, candidates []*blockRetrieval) *blockRetrieval {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	band := f.lastServed[priority]
+	if band == nil {
+		band = make(map[FairnessKey]uint64)
+		f.lastServed[priority] = band
+	}
+
+	var winner *blockRetrieval
+	var winnerServed uint64
+	for _, br := range candidates {
+		served := band[br.fairnessKey]
+		if winner == nil || served < winnerServed ||
+			(served == winnerServed && br.insertionOrder < winner.insertionOrder) {
+			winner, winnerServed = br, served
+		}
+	}
+
+	f.tick++
+	band[winner.fairnessKey] = f.tick
+	return winner
+}
+
 // blockRetrievalRequest represents one consumer's request for a block.
 type blockRetrievalRequest struct {
 	block  Block
@@ -47,13 +366,38 @@ type blockRetrieval struct {
 	// state of global request counter when this retrieval was created;
 	// maintains FIFO
 	insertionOrder uint64
+	// set once a worker has been handed this retrieval, for the supervisor
+	// to detect a worker that's taking too long (or has died outright)
+	startedAt time.Time
+	// how many times this retrieval has already been timed out and
+	// re-enqueued
+	retryCount int
+	// true once this retrieval has been finalized (by FinalizeRequest,
+	// retryOrFail's retry/give-up paths, or Shutdown), so a late or
+	// duplicate FinalizeRequest call for it becomes a no-op
+	finalized bool
+
+	//// Admission-control bookkeeping
+	// the estimated size used to reserve tokens with admissionController
+	sizeBytes int64
+	// whether sizeBytes was large enough to count against
+	// QueueLimits.MaxExpensiveInFlight
+	expensive bool
+
+	//// Fair-scheduling metadata
+	// the key this retrieval competes for a proportional share under,
+	// within its priority band
+	fairnessKey FairnessKey
+	// if true, this retrieval opts out of fair scheduling: within its
+	// priority band it's served in strict FIFO order instead
+	strictPriority bool
 }
 
 // blockRetrievalQueue manages block retrieval requests. Higher priority
 // requests are executed first. Requests are executed in FIFO order within a
 // given priority level.
 type blockRetrievalQueue struct {
-	// protects everything in this struct except workerQueue
+	// protects everything in this struct except workerQueue and admission
 	mtx sync.RWMutex
 	// queued or in progress retrievals
 	ptrs map[BlockPointer]*blockRetrieval
@@ -68,27 +412,200 @@ type blockRetrievalQueue struct {
 	workerQueue chan chan *blockRetrieval
 	// channel to be closed when we're done accepting requests
 	doneCh chan struct{}
+
+	// admission bounds how many retrievals/bytes are in flight at once
+	admission *admissionController
+	// finishedCache short-circuits a repeat Request for a block that was
+	// just retrieved
+	finishedCache *finishedRetrievalCache
+	// fairness decides, within a priority band, which FairnessKey's
+	// retrieval a worker gets next
+	fairness *fairScheduler
 }
 
 // newBlockRetrievalQueue creates a new block retrieval queue. The numWorkers
 // parameter determines how many workers can concurrently call WorkOnRequest
-// (more than numWorkers will block).
-func newBlockRetrievalQueue(numWorkers int) *blockRetrievalQueue {
-	return &blockRetrievalQueue{
-		ptrs:        make(map[BlockPointer]*blockRetrieval),
-		heap:        &blockRetrievalHeap{},
-		workerQueue: make(chan chan *blockRetrieval, numWorkers),
-		doneCh:      make(chan struct{}),
+// (more than numWorkers will block). limits bounds how much work the queue
+// will admit concurrently; its zero value disables admission control.
+// finishedCacheSize is the capacity of the queue's recently-completed-block
+// FIFO cache; zero or negative uses defaultFinishedRetrievalCacheSize.
+func newBlockRetrievalQueue(
+	numWorkers int, limits QueueLimits, finishedCacheSize int) *blockRetrievalQueue {
+	if finishedCacheSize <= 0 {
+		finishedCacheSize = defaultFinishedRetrievalCacheSize
+	}
+	doneCh := make(chan struct{})
+	brq := &blockRetrievalQueue{
+		ptrs:          make(map[BlockPointer]*blockRetrieval),
+		heap:          &blockRetrievalHeap{},
+		workerQueue:   make(chan chan *blockRetrieval, numWorkers),
+		doneCh:        doneCh,
+		admission:     &admissionController{limits: limits, done: doneCh},
+		finishedCache: newFinishedRetrievalCache(finishedCacheSize),
+		fairness:      newFairScheduler(),
+	}
+	go brq.supervise()
+	return brq
+}
+
+// Metrics returns a snapshot of the queue's admission-control and
+// finished-retrieval-cache counters.
+func (brq *blockRetrievalQueue) Metrics() QueueMetrics {
+	m := brq.admission.metrics()
+	m.CacheHits, m.CacheMisses = brq.finishedCache.metrics()
+	return m
+}
+
+// PurgePointer removes ptr from the queue's finished-retrieval cache, if
+// present. Callers that know a previously-cached block is now stale (e.g.
+// the block ops layer, after a write) should call this so a future Request
+// doesn't short-circuit to the stale copy.
+func (brq *blockRetrievalQueue) PurgePointer(ptr BlockPointer) {
+	brq.finishedCache.purge(ptr)
+}
+
+// timeoutForPriority returns how long a retrieval at the given priority may
+// sit with a worker before the supervisor considers it dead.
+func (brq *blockRetrievalQueue) timeoutForPriority(priority int) time.Duration {
+	if priority >= defaultOnDemandRequestPriority {
+		return onDemandRetrievalTimeout
+	}
+	return defaultRetrievalTimeout
+}
+
+// supervise periodically scans in-flight retrievals for ones that have been
+// with a worker for longer than their deadline allows, and recovers them by
+// canceling and re-enqueueing (or, past maxRetrievalRetries, failing them).
+// This guards against a worker that has died or wedged without ever calling
+// FinalizeRequest.
+func (brq *blockRetrievalQueue) supervise() {
+	ticker := time.NewTicker(retrievalSupervisorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-brq.doneCh:
+			return
+		case <-ticker.C:
+			brq.checkDeadlines()
+		}
+	}
+}
+
+func (brq *blockRetrievalQueue) checkDeadlines() {
+	now := time.Now()
+	brq.mtx.RLock()
+	var timedOut []*blockRetrieval
+	for _, br := range brq.ptrs {
+		if br.startedAt.IsZero() {
+			// Still sitting in the heap; no worker has picked it up yet.
+			continue
+		}
+		if now.Sub(br.startedAt) > brq.timeoutForPriority(br.priority) {
+			timedOut = append(timedOut, br)
+		}
+	}
+	brq.mtx.RUnlock()
+
+	for _, br := range timedOut {
+		brq.retryOrFail(br)
 	}
 }
 
+// retryOrFail is called for a retrieval whose worker has exceeded its
+// deadline. It cancels the retrieval's CoalescingContext so the wedged
+// worker's RPC is no longer waited on, and either re-enqueues a fresh
+// attempt at the back of its priority band, or, once retried too many
+// times, fails it with BlockRetrievalTimeout. The stale blockRetrieval is
+// replaced in ptrs (rather than mutated in place) so that a late
+// FinalizeRequest call from the original worker becomes a harmless no-op.
+func (brq *blockRetrievalQueue) retryOrFail(stale *blockRetrieval) {
+	stale.cancelFunc()
+
+	brq.mtx.Lock()
+	current, ok := brq.ptrs[stale.blockPtr]
+	if !ok || current != stale {
+		// Already finalized, or already recovered by a previous tick.
+		brq.mtx.Unlock()
+		return
+	}
+
+	if stale.retryCount >= maxRetrievalRetries {
+		stale.finalized = true
+		delete(brq.ptrs, stale.blockPtr)
+		brq.mtx.Unlock()
+		brq.admission.release(stale.sizeBytes, stale.expensive)
+		err := BlockRetrievalTimeout{Ptr: stale.blockPtr}
+		for _, r := range stale.requests {
+			r.doneCh <- err
+		}
+		return
+	}
+
+	stale.finalized = true
+	next := &blockRetrieval{
+		blockPtr:       stale.blockPtr,
+		kmd:            stale.kmd,
+		requests:       stale.requests,
+		index:          -1,
+		priority:       stale.priority,
+		insertionOrder: brq.insertionCount,
+		retryCount:     stale.retryCount + 1,
+		sizeBytes:      stale.sizeBytes,
+		expensive:      stale.expensive,
+		fairnessKey:    stale.fairnessKey,
+		strictPriority: stale.strictPriority,
+	}
+	next.ctx, next.cancelFunc = NewCoalescingContext(context.Background())
+	brq.insertionCount++
+	brq.ptrs[next.blockPtr] = next
+	heap.Push(brq.heap, next)
+	brq.mtx.Unlock()
+
+	brq.notifyWorker()
+}
+
+// popIfNotEmpty removes and returns the next retrieval a worker should work
+// on. Within the top (highest) priority band present in the heap, retrievals
+// that opted out with strictPriority are dispatched first, in strict FIFO
+// order among themselves, so correctness-sensitive callers (e.g. journal
+// flushes) aren't reordered. Only once there are none left pending does a
+// worker draw from the rest of the band via round-robin across its distinct
+// FairnessKeys, every key weighted equally; those non-strict retrievals are
+// otherwise unaffected by any strict retrieval sharing their priority band.
 func (brq *blockRetrievalQueue) popIfNotEmpty() *blockRetrieval {
 	brq.mtx.Lock()
 	defer brq.mtx.Unlock()
-	if brq.heap.Len() > 0 {
-		return heap.Pop(brq.heap).(*blockRetrieval)
+	if brq.heap.Len() == 0 {
+		return nil
+	}
+
+	topPriority := (*brq.heap)[0].priority
+	var strict, fair []*blockRetrieval
+	for _, br := range *brq.heap {
+		if br.priority != topPriority {
+			continue
+		}
+		if br.strictPriority {
+			strict = append(strict, br)
+		} else {
+			fair = append(fair, br)
+		}
+	}
+
+	var winner *blockRetrieval
+	if len(strict) > 0 {
+		for _, br := range strict {
+			if winner == nil || br.insertionOrder < winner.insertionOrder {
+				winner = br
+			}
+		}
+	} else {
+		winner = brq.fairness.next(topPriority, fair)
 	}
-	return nil
+
+	heap.Remove(brq.heap, winner.index)
+	winner.startedAt = time.Now()
+	return winner
 }
 
 // notifyWorker notifies workers that there is a new request for processing.
@@ -107,8 +624,51 @@ func (brq *blockRetrievalQueue) notifyWorker() {
 	}()
 }
 
-// Request submits a block request to the queue.
-func (brq *blockRetrievalQueue) Request(ctx context.Context, priority int, kmd KeyMetadata, ptr BlockPointer, block Block) <-chan error {
+// joinRetrievalLocked appends block as a new waiter on br, elevating its
+// priority if necessary. If strict is set, br permanently opts out of fair
+// scheduling (see popIfNotEmpty). brq.mtx must be held.
+func (brq *blockRetrievalQueue) joinRetrievalLocked(
+	br *blockRetrieval, priority int, block Block, strict bool) chan error {
+	ch := make(chan error, 1)
+	br.requests = append(br.requests, &blockRetrievalRequest{
+		block:  block,
+		doneCh: ch,
+	})
+	if strict {
+		br.strictPriority = true
+	}
+	// If the new request priority is higher, elevate the retrieval in the
+	// queue. Skip this if the request is no longer in the queue (which means
+	// it's actively being processed).
+	if br.index != -1 && priority > br.priority {
+		br.priority = priority
+		heap.Fix(brq.heap, br.index)
+	}
+	return ch
+}
+
+// effectiveFairnessKey returns key, or if key is empty, a default derived
+// from kmd's TLF, so unlabeled requests still get a fair share against each
+// other by TLF.
+func effectiveFairnessKey(kmd KeyMetadata, key FairnessKey) FairnessKey {
+	if key != "" {
+		return key
+	}
+	return FairnessKey(kmd.TlfID().String())
+}
+
+// Request submits a block request to the queue. If no retrieval is already
+// in flight for ptr, this reserves admission-control tokens for it (see
+// QueueLimits), blocking respecting ctx if the queue is currently saturated.
+//
+// fairness groups this request with others for proportional scheduling
+// within its priority band (see FairnessKey); the zero value defaults to
+// kmd's TLF ID. If strict is true, this request's retrieval opts out of fair
+// scheduling and is always served in strict priority/FIFO order instead,
+// for correctness-sensitive callers like journal flushes.
+func (brq *blockRetrievalQueue) Request(
+	ctx context.Context, priority int, kmd KeyMetadata, ptr BlockPointer,
+	block Block, fairness FairnessKey, strict bool) <-chan error {
 	// Only continue if we haven't been shut down
 	select {
 	case <-brq.doneCh:
@@ -118,49 +678,83 @@ func (brq *blockRetrievalQueue) Request(ctx context.Context, priority int, kmd K
 	default:
 	}
 
-	brq.mtx.Lock()
-	defer brq.mtx.Unlock()
-	// Might have to retry if the context has been canceled.
-	// This loop will iterate a maximum of 2 times. It either hits the `return`
-	// statement at the bottom on the first iteration, or the `continue`
-	// statement first which causes it to `return` on the next iteration.
+	if cached, ok := brq.finishedCache.get(ptr, kmd); ok {
+		block.Set(cached)
+		ch := make(chan error, 1)
+		ch <- nil
+		return ch
+	}
+
 	for {
-		br, exists := brq.ptrs[ptr]
-		if !exists {
-			// Add to the heap
-			br = &blockRetrieval{
-				blockPtr:       ptr,
-				kmd:            kmd,
-				index:          -1,
-				priority:       priority,
-				insertionOrder: brq.insertionCount,
-			}
-			br.ctx, br.cancelFunc = NewCoalescingContext(ctx)
-			brq.insertionCount++
-			brq.ptrs[ptr] = br
-			heap.Push(brq.heap, br)
-			defer brq.notifyWorker()
-		} else {
+		brq.mtx.Lock()
+		if br, exists := brq.ptrs[ptr]; exists {
 			err := br.ctx.AddContext(ctx)
 			if err == context.Canceled {
 				// We need to delete the request pointer, but we'll still let the
 				// existing request be processed by a worker.
 				delete(brq.ptrs, br.blockPtr)
+				brq.mtx.Unlock()
 				continue
 			}
+			ch := brq.joinRetrievalLocked(br, priority, block, strict)
+			brq.mtx.Unlock()
+			return ch
 		}
-		ch := make(chan error, 1)
-		br.requests = append(br.requests, &blockRetrievalRequest{
-			block:  block,
-			doneCh: ch,
-		})
-		// If the new request priority is higher, elevate the retrieval in the
-		// queue.  Skip this if the request is no longer in the queue (which means
-		// it's actively being processed).
-		if br.index != -1 && priority > br.priority {
-			br.priority = priority
-			heap.Fix(brq.heap, br.index)
+		brq.mtx.Unlock()
+
+		// No retrieval in flight for this pointer: admit a new one. This
+		// may block (respecting ctx), so it must happen without holding
+		// brq.mtx.
+		sizeBytes := estimatedBlockSize(ptr)
+		expensive := brq.admission.isExpensive(sizeBytes)
+		if err := brq.admission.admit(ctx, priority, sizeBytes, expensive); err != nil {
+			ch := make(chan error, 1)
+			ch <- err
+			return ch
 		}
+
+		brq.mtx.Lock()
+		if br, exists := brq.ptrs[ptr]; exists {
+			// Lost the race while waiting on admission: someone else
+			// already created the retrieval. Give back our reservation and
+			// join theirs instead.
+			brq.mtx.Unlock()
+			brq.admission.release(sizeBytes, expensive)
+			brq.mtx.Lock()
+			br, exists = brq.ptrs[ptr]
+			if !exists {
+				brq.mtx.Unlock()
+				continue
+			}
+			err := br.ctx.AddContext(ctx)
+			if err == context.Canceled {
+				delete(brq.ptrs, br.blockPtr)
+				brq.mtx.Unlock()
+				continue
+			}
+			ch := brq.joinRetrievalLocked(br, priority, block, strict)
+			brq.mtx.Unlock()
+			return ch
+		}
+
+		br := &blockRetrieval{
+			blockPtr:       ptr,
+			kmd:            kmd,
+			index:          -1,
+			priority:       priority,
+			insertionOrder: brq.insertionCount,
+			sizeBytes:      sizeBytes,
+			expensive:      expensive,
+			fairnessKey:    effectiveFairnessKey(kmd, fairness),
+			strictPriority: strict,
+		}
+		br.ctx, br.cancelFunc = NewCoalescingContext(ctx)
+		brq.insertionCount++
+		brq.ptrs[ptr] = br
+		heap.Push(brq.heap, br)
+		ch := brq.joinRetrievalLocked(br, priority, block, strict)
+		brq.mtx.Unlock()
+		brq.notifyWorker()
 		return ch
 	}
 }
@@ -175,15 +769,29 @@ func (brq *blockRetrievalQueue) WorkOnRequest() <-chan *blockRetrieval {
 
 // FinalizeRequest is the last step of a retrieval request once a block has
 // been obtained. It removes the request from the blockRetrievalQueue,
-// preventing more requests from mutating the retrieval, then notifies all
-// subscribed requests.
+// releases its admission-control tokens, and notifies all subscribed
+// requests. It is idempotent: a late or duplicate call for a retrieval that
+// has already been finalized is a no-op, rather than double-delivering to
+// doneCh.
 func (brq *blockRetrievalQueue) FinalizeRequest(retrieval *blockRetrieval, block Block, err error) {
 	brq.mtx.Lock()
-	// This might have already been removed if the context has been canceled.
-	// That's okay, because this will then be a no-op.
-	delete(brq.ptrs, retrieval.blockPtr)
+	if retrieval.finalized {
+		brq.mtx.Unlock()
+		return
+	}
+	retrieval.finalized = true
+	// This might have already been removed from ptrs if the context was
+	// canceled, or if it was superseded by a retry. Either way, only
+	// delete it here if it's still the current occupant.
+	if current, ok := brq.ptrs[retrieval.blockPtr]; ok && current == retrieval {
+		delete(brq.ptrs, retrieval.blockPtr)
+	}
 	brq.mtx.Unlock()
 	retrieval.cancelFunc()
+	brq.admission.release(retrieval.sizeBytes, retrieval.expensive)
+	if err == nil && block != nil {
+		brq.finishedCache.put(retrieval.blockPtr, retrieval.kmd, block)
+	}
 
 	for _, r := range retrieval.requests {
 		req := r
@@ -196,11 +804,28 @@ func (brq *blockRetrievalQueue) FinalizeRequest(retrieval *blockRetrieval, block
 	}
 }
 
-// Shutdown is called when we are no longer accepting requests
+// Shutdown is called when we are no longer accepting requests. Any
+// retrievals still sitting in the heap (i.e., not yet claimed by a worker)
+// are drained and failed with io.EOF so that no caller of Request is left
+// blocked on a result that will never arrive.
 func (brq *blockRetrievalQueue) Shutdown() {
 	select {
 	case <-brq.doneCh:
+		return
 	default:
 		close(brq.doneCh)
 	}
-}
\ No newline at end of file
+
+	brq.mtx.Lock()
+	defer brq.mtx.Unlock()
+	for brq.heap.Len() > 0 {
+		retrieval := heap.Pop(brq.heap).(*blockRetrieval)
+		retrieval.finalized = true
+		delete(brq.ptrs, retrieval.blockPtr)
+		retrieval.cancelFunc()
+		brq.admission.release(retrieval.sizeBytes, retrieval.expensive)
+		for _, r := range retrieval.requests {
+			r.doneCh <- io.EOF
+		}
+	}
+}
@@ -0,0 +1,409 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"container/heap"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// fakeKeyMetadata satisfies KeyMetadata for cache tests by embedding the
+// (nil) interface and overriding only TlfID, the one method
+// finishedRetrievalCache actually calls. Any other method would panic on
+// the embedded nil value, so tests using this must not exercise one.
+type fakeKeyMetadata struct {
+	KeyMetadata
+}
+
+func (fakeKeyMetadata) TlfID() tlf.ID {
+	return tlf.ID{}
+}
+
+// newTestBlockRetrieval builds a minimal *blockRetrieval suitable for
+// exercising retryOrFail/FinalizeRequest/popIfNotEmpty directly, without
+// going through Request (and so without needing a real KeyMetadata, Block,
+// or CoalescingContext).
+func newTestBlockRetrieval(
+	ptr BlockPointer, priority int, fairnessKey FairnessKey,
+	strict bool, insertionOrder uint64) *blockRetrieval {
+	return &blockRetrieval{
+		blockPtr:       ptr,
+		cancelFunc:     func() {},
+		requests:       []*blockRetrievalRequest{{doneCh: make(chan error, 1)}},
+		index:          -1,
+		priority:       priority,
+		insertionOrder: insertionOrder,
+		fairnessKey:    fairnessKey,
+		strictPriority: strict,
+	}
+}
+
+// TestFinalizeRequestNoopAfterRetryGivesUp checks that once retryOrFail has
+// given up on a retrieval (maxRetrievalRetries exceeded), a subsequent
+// FinalizeRequest call for that same stale retrieval -- e.g. from a worker
+// that was merely slow, not actually dead -- is a no-op: it must not
+// double-release admission-control tokens or attempt a second send on a
+// doneCh that retryOrFail already delivered to.
+func TestFinalizeRequestNoopAfterRetryGivesUp(t *testing.T) {
+	brq := newBlockRetrievalQueue(1, QueueLimits{}, 0)
+	defer brq.Shutdown()
+
+	stale := newTestBlockRetrieval(BlockPointer{}, defaultOnDemandRequestPriority, "", false, 0)
+	stale.retryCount = maxRetrievalRetries
+	stale.startedAt = time.Now().Add(-time.Hour)
+
+	brq.mtx.Lock()
+	brq.ptrs[stale.blockPtr] = stale
+	brq.mtx.Unlock()
+
+	brq.retryOrFail(stale)
+
+	if !stale.finalized {
+		t.Fatal("retryOrFail's give-up path did not mark the stale retrieval finalized")
+	}
+	select {
+	case err := <-stale.requests[0].doneCh:
+		if _, ok := err.(BlockRetrievalTimeout); !ok {
+			t.Fatalf("got %v, expected a BlockRetrievalTimeout", err)
+		}
+	default:
+		t.Fatal("retryOrFail did not deliver BlockRetrievalTimeout to doneCh")
+	}
+	inFlightAfterGiveUp := brq.admission.inFlight
+
+	// Simulate the original (merely slow, not actually dead) worker finally
+	// calling FinalizeRequest for the same retrieval. This must return
+	// promptly without re-sending on doneCh (whose buffer is already full)
+	// or double-releasing admission tokens.
+	done := make(chan struct{})
+	go func() {
+		brq.FinalizeRequest(stale, nil, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("FinalizeRequest blocked on an already-finalized retrieval; " +
+			"it tried to re-send on a full doneCh")
+	}
+	if brq.admission.inFlight != inFlightAfterGiveUp {
+		t.Fatalf("FinalizeRequest double-released admission tokens: "+
+			"inFlight went from %d to %d", inFlightAfterGiveUp, brq.admission.inFlight)
+	}
+}
+
+// TestPopIfNotEmptyStrictPriorityScopedToItself checks that a single
+// strictPriority retrieval in a priority band does not force every other,
+// unrelated retrieval in that band back to strict FIFO: fair round-robin
+// across FairnessKeys should still apply among the non-strict retrievals.
+func TestPopIfNotEmptyStrictPriorityScopedToItself(t *testing.T) {
+	brq := newBlockRetrievalQueue(1, QueueLimits{}, 0)
+	defer brq.Shutdown()
+
+	// Both of tlf-a's retrievals are inserted before tlf-b's, so plain FIFO
+	// order (the pre-fix behavior for the whole band, once any retrieval in
+	// it set strictPriority) would serve them in insertion order: strict,
+	// fairA1, fairA2, fairB1. Fair round-robin instead must give tlf-b a
+	// turn before tlf-a's second retrieval.
+	const priority = defaultOnDemandRequestPriority
+	strict := newTestBlockRetrieval(BlockPointer{EncodedSize: 1}, priority, "strict-tlf", true, 0)
+	fairA1 := newTestBlockRetrieval(BlockPointer{EncodedSize: 2}, priority, "tlf-a", false, 1)
+	fairA2 := newTestBlockRetrieval(BlockPointer{EncodedSize: 3}, priority, "tlf-a", false, 2)
+	fairB1 := newTestBlockRetrieval(BlockPointer{EncodedSize: 4}, priority, "tlf-b", false, 3)
+
+	brq.mtx.Lock()
+	heap.Push(brq.heap, strict)
+	heap.Push(brq.heap, fairA1)
+	heap.Push(brq.heap, fairA2)
+	heap.Push(brq.heap, fairB1)
+	brq.mtx.Unlock()
+
+	// The strict retrieval must come out first, in FIFO order among
+	// strict-flagged retrievals.
+	if got := brq.popIfNotEmpty(); got != strict {
+		t.Fatalf("expected the strict retrieval first, got %v", got.blockPtr)
+	}
+
+	second := brq.popIfNotEmpty()
+	third := brq.popIfNotEmpty()
+	if second != fairA1 {
+		t.Fatalf("expected tlf-a's first retrieval second, got %v", second.blockPtr)
+	}
+	if third != fairB1 {
+		t.Fatal("non-strict retrievals fell back to strict FIFO because an " +
+			"unrelated retrieval in the same band set strictPriority: " +
+			"tlf-b was starved behind tlf-a's second retrieval instead of " +
+			"getting its fair round-robin turn")
+	}
+}
+
+// TestRetryOrFailReenqueuesWithIncrementedRetryCount checks the retry path
+// of retryOrFail (as opposed to the give-up path, which
+// TestFinalizeRequestNoopAfterRetryGivesUp already covers): a stale
+// retrieval under maxRetrievalRetries is replaced in ptrs by a fresh
+// blockRetrieval carrying the same pointer, requests, and fairness/priority
+// metadata, with retryCount incremented, enqueued for a worker to pick up.
+func TestRetryOrFailReenqueuesWithIncrementedRetryCount(t *testing.T) {
+	brq := newBlockRetrievalQueue(1, QueueLimits{}, 0)
+	defer brq.Shutdown()
+
+	ptr := BlockPointer{EncodedSize: 7}
+	stale := newTestBlockRetrieval(ptr, defaultOnDemandRequestPriority, "tlf-a", false, 0)
+	stale.retryCount = 1
+	stale.startedAt = time.Now().Add(-time.Hour)
+
+	brq.mtx.Lock()
+	brq.ptrs[ptr] = stale
+	brq.mtx.Unlock()
+
+	brq.retryOrFail(stale)
+
+	if !stale.finalized {
+		t.Fatal("retryOrFail's retry path did not mark the stale retrieval finalized")
+	}
+	select {
+	case err := <-stale.requests[0].doneCh:
+		t.Fatalf("retry path should not deliver to doneCh, got %v", err)
+	default:
+	}
+
+	brq.mtx.RLock()
+	next, ok := brq.ptrs[ptr]
+	brq.mtx.RUnlock()
+	if !ok {
+		t.Fatal("retryOrFail's retry path removed the pointer from ptrs instead of replacing it")
+	}
+	if next == stale {
+		t.Fatal("retryOrFail's retry path mutated the stale retrieval in place instead of replacing it")
+	}
+	if next.retryCount != stale.retryCount+1 {
+		t.Fatalf("got retryCount %d, expected %d", next.retryCount, stale.retryCount+1)
+	}
+	if next.fairnessKey != stale.fairnessKey || next.priority != stale.priority {
+		t.Fatalf("replacement retrieval lost metadata: %+v", next)
+	}
+
+	popped := brq.popIfNotEmpty()
+	if popped != next {
+		t.Fatal("the re-enqueued retrieval was not available for a worker to pick up")
+	}
+}
+
+// TestFairSchedulerRoundRobinsAcrossKeys checks that fairScheduler.next gives
+// each FairnessKey present in a band a turn before repeating any key, even
+// when one key has more candidates pending than another -- so a single busy
+// TLF can't claim a disproportionate share of dispatches.
+func TestFairSchedulerRoundRobinsAcrossKeys(t *testing.T) {
+	f := newFairScheduler()
+	const priority = defaultOnDemandRequestPriority
+
+	aHeavy := []*blockRetrieval{
+		newTestBlockRetrieval(BlockPointer{EncodedSize: 1}, priority, "tlf-a", false, 0),
+		newTestBlockRetrieval(BlockPointer{EncodedSize: 2}, priority, "tlf-a", false, 1),
+		newTestBlockRetrieval(BlockPointer{EncodedSize: 3}, priority, "tlf-a", false, 2),
+	}
+	bLight := newTestBlockRetrieval(BlockPointer{EncodedSize: 4}, priority, "tlf-b", false, 3)
+
+	remaining := append(append([]*blockRetrieval{}, aHeavy...), bLight)
+	pop := func() *blockRetrieval {
+		winner := f.next(priority, remaining)
+		for i, br := range remaining {
+			if br == winner {
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+		return winner
+	}
+
+	// tlf-a has 3 candidates queued to tlf-b's 1, but tlf-b must still be
+	// served before tlf-a gets its second turn.
+	first := pop()
+	second := pop()
+	if first.fairnessKey != "tlf-a" {
+		t.Fatalf("expected tlf-a served first (lowest insertion order), got %s", first.fairnessKey)
+	}
+	if second != bLight {
+		t.Fatalf("expected tlf-b served on its first turn before tlf-a's second, got %s", second.fairnessKey)
+	}
+}
+
+// TestFairSchedulerTracksBandsIndependently checks that round-robin state is
+// scoped per priority band: a key that was just served at one priority
+// doesn't lose its turn at a different priority.
+func TestFairSchedulerTracksBandsIndependently(t *testing.T) {
+	f := newFairScheduler()
+	highA := newTestBlockRetrieval(BlockPointer{EncodedSize: 1}, 200, "tlf-a", false, 0)
+	highB := newTestBlockRetrieval(BlockPointer{EncodedSize: 2}, 200, "tlf-b", false, 1)
+	lowA := newTestBlockRetrieval(BlockPointer{EncodedSize: 3}, 100, "tlf-a", false, 2)
+
+	if got := f.next(200, []*blockRetrieval{highA, highB}); got != highA {
+		t.Fatalf("expected tlf-a served first in the priority-200 band, got %s", got.fairnessKey)
+	}
+	// tlf-a was just served, but only within the priority-200 band; the
+	// priority-100 band has never served tlf-a and should still pick it.
+	if got := f.next(100, []*blockRetrieval{lowA}); got != lowA {
+		t.Fatalf("priority bands are not independent: got %s", got.fairnessKey)
+	}
+}
+
+// TestFinishedRetrievalCacheHitMissPurgeAndEviction checks
+// finishedRetrievalCache's get/put hit and miss behavior, that purge makes a
+// cached entry unreachable, and that it evicts in FIFO order once more than
+// maxSize entries have been put.
+func TestFinishedRetrievalCacheHitMissPurgeAndEviction(t *testing.T) {
+	kmd := fakeKeyMetadata{}
+	ptr1 := BlockPointer{EncodedSize: 1}
+	ptr2 := BlockPointer{EncodedSize: 2}
+	ptr3 := BlockPointer{EncodedSize: 3}
+
+	c := newFinishedRetrievalCache(2)
+
+	if _, ok := c.get(ptr1, kmd); ok {
+		t.Fatal("expected a miss for a pointer that was never cached")
+	}
+
+	c.put(ptr1, kmd, nil)
+	if _, ok := c.get(ptr1, kmd); !ok {
+		t.Fatal("expected a hit right after put")
+	}
+
+	c.put(ptr2, kmd, nil)
+	// maxSize is 2; adding a third entry must evict ptr1, the oldest.
+	c.put(ptr3, kmd, nil)
+	if _, ok := c.get(ptr1, kmd); ok {
+		t.Fatal("expected ptr1 to have been FIFO-evicted once maxSize was exceeded")
+	}
+	if _, ok := c.get(ptr2, kmd); !ok {
+		t.Fatal("expected ptr2 to survive eviction")
+	}
+	if _, ok := c.get(ptr3, kmd); !ok {
+		t.Fatal("expected ptr3 to survive eviction")
+	}
+
+	c.purge(ptr2)
+	if _, ok := c.get(ptr2, kmd); ok {
+		t.Fatal("expected a miss for ptr2 after purge")
+	}
+
+	hits, misses := c.metrics()
+	if hits == 0 || misses == 0 {
+		t.Fatalf("expected both hits and misses to have been recorded, got hits=%d misses=%d", hits, misses)
+	}
+}
+
+// TestAdmissionControllerBlocksUntilReleased checks that admit blocks a
+// request that doesn't fit under MaxInFlight, admits it once a concurrent
+// release frees capacity, and that inFlight/inFlightBytes/expensiveInFlight
+// are accounted for correctly across the admit/release pair.
+func TestAdmissionControllerBlocksUntilReleased(t *testing.T) {
+	a := &admissionController{
+		limits: QueueLimits{
+			MaxInFlight:             1,
+			ExpensiveThresholdBytes: 100,
+			MaxExpensiveInFlight:    1,
+		},
+	}
+	ctx := context.Background()
+
+	if err := a.admit(ctx, 0, 50, a.isExpensive(50)); err != nil {
+		t.Fatalf("first admit: %v", err)
+	}
+	if a.inFlight != 1 || a.inFlightBytes != 50 || a.expensiveInFlight != 0 {
+		t.Fatalf("unexpected accounting after first admit: %+v", a)
+	}
+
+	admitted := make(chan error, 1)
+	go func() {
+		admitted <- a.admit(ctx, 0, 200, a.isExpensive(200))
+	}()
+
+	select {
+	case <-admitted:
+		t.Fatal("second admit did not block on a saturated MaxInFlight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	a.release(50, false)
+
+	select {
+	case err := <-admitted:
+		if err != nil {
+			t.Fatalf("second admit: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("second admit did not unblock after release freed capacity")
+	}
+	if a.inFlight != 1 || a.inFlightBytes != 200 || a.expensiveInFlight != 1 {
+		t.Fatalf("unexpected accounting after second admit: %+v", a)
+	}
+
+	a.release(200, true)
+	if a.inFlight != 0 || a.inFlightBytes != 0 || a.expensiveInFlight != 0 {
+		t.Fatalf("unexpected accounting after final release: %+v", a)
+	}
+}
+
+// TestAdmissionControllerOnDemandBypassesThrottle checks that a request at
+// or above defaultOnDemandRequestPriority is admitted immediately even when
+// the queue is already saturated, rather than queueing behind it.
+func TestAdmissionControllerOnDemandBypassesThrottle(t *testing.T) {
+	a := &admissionController{limits: QueueLimits{MaxInFlight: 1}}
+	ctx := context.Background()
+
+	if err := a.admit(ctx, 0, 10, false); err != nil {
+		t.Fatalf("background admit: %v", err)
+	}
+	if err := a.admit(ctx, defaultOnDemandRequestPriority, 10, false); err != nil {
+		t.Fatalf("on-demand admit should bypass the throttle: %v", err)
+	}
+	if a.inFlight != 2 {
+		t.Fatalf("expected both requests admitted, inFlight=%d", a.inFlight)
+	}
+}
+
+// TestAdmissionControllerAdmitWakesOnDone checks that a request blocked in
+// admit() on a saturated queue gives up with io.EOF as soon as the owning
+// queue's done channel is closed, even if its own ctx is never canceled --
+// otherwise a Request caller could be left blocked forever once Shutdown
+// stops the deadline supervisor that would have freed up capacity.
+func TestAdmissionControllerAdmitWakesOnDone(t *testing.T) {
+	done := make(chan struct{})
+	a := &admissionController{
+		limits: QueueLimits{MaxInFlight: 1},
+		done:   done,
+	}
+	ctx := context.Background()
+	if err := a.admit(ctx, 0, 10, false); err != nil {
+		t.Fatalf("first admit: %v", err)
+	}
+
+	admitted := make(chan error, 1)
+	go func() {
+		admitted <- a.admit(ctx, 0, 10, false)
+	}()
+
+	select {
+	case <-admitted:
+		t.Fatal("second admit did not block on a saturated MaxInFlight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(done)
+
+	select {
+	case err := <-admitted:
+		if err != io.EOF {
+			t.Fatalf("got %v, expected io.EOF once the queue was done", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("admit did not wake up once the owning queue's done channel closed")
+	}
+}
@@ -6,7 +6,6 @@ package libkbfs
 
 import (
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/keybase/client/go/logger"
@@ -24,22 +23,45 @@ type ECQUCtxTagKey struct{}
 // EventuallyConsistentQuotaUsage.
 const ECQUID = "ECQU"
 
+// quotaFetchTimeout bounds how long a single getAndCache RPC, shared by
+// however many callers are currently waiting on it, is allowed to run. It's
+// applied on a context independent of any individual caller's, so that one
+// caller giving up doesn't cut the RPC short for every other caller sharing
+// it.
+const quotaFetchTimeout = 10 * time.Second
+
 type cachedQuotaUsage struct {
 	timestamp  time.Time
 	usageBytes int64
 	limitBytes int64
 }
 
+// QuotaUsage is a snapshot of a user's quota usage, pushed to subscribers of
+// EventuallyConsistentQuotaUsage whenever the cached usage is refreshed.
+type QuotaUsage struct {
+	UsageBytes int64
+	LimitBytes int64
+}
+
 // EventuallyConsistentQuotaUsage keeps tracks of quota usage, in a way user of
 // which can choose to accept stale data to reduce calls into block servers.
 type EventuallyConsistentQuotaUsage struct {
 	config Config
 	log    logger.Logger
 
-	backgroundInProcess int32
-
 	mu     sync.RWMutex
 	cached cachedQuotaUsage
+	// fetchCh is non-nil while a getAndCache call is in flight. A blocking
+	// caller that finds it non-nil waits on it instead of triggering another
+	// RPC, and receives the same fresh result once it's closed; a background
+	// refresh that finds it non-nil is skipped.
+	fetchCh chan struct{}
+	// fetchErr is the error, if any, from the fetch that closed fetchCh most
+	// recently. It's read by fetchOrWait callers after fetchCh closes.
+	fetchErr error
+
+	subscribersMu sync.Mutex
+	subscribers   []chan<- QuotaUsage
 }
 
 // NewEventuallyConsistentQuotaUsage creates a new
@@ -77,6 +99,103 @@ func (q *EventuallyConsistentQuotaUsage) getAndCache(
 	return usage, nil
 }
 
+// startFetchLocked registers a new in-flight fetch and returns the channel
+// that will be closed when it completes. q.mu must be held, and q.fetchCh
+// must be nil.
+func (q *EventuallyConsistentQuotaUsage) startFetchLocked() chan struct{} {
+	ch := make(chan struct{})
+	q.fetchCh = ch
+	return ch
+}
+
+// runFetch performs the RPC, releases any waiters on ch, and pushes the
+// result to subscribers. It's always run in its own goroutine, started either
+// by fetchOrWait for blocking callers or by Get's background-refresh path.
+func (q *EventuallyConsistentQuotaUsage) runFetch(
+	ctx context.Context, ch chan struct{}) (cachedQuotaUsage, error) {
+	usage, err := q.getAndCache(ctx)
+
+	q.mu.Lock()
+	q.fetchCh = nil
+	q.fetchErr = err
+	q.mu.Unlock()
+	close(ch)
+
+	if err != nil {
+		return cachedQuotaUsage{}, err
+	}
+	q.notifySubscribers(usage)
+	return usage, nil
+}
+
+// fetchOrWait ensures at most one getAndCache call is outstanding at a time.
+// If a fetch is already in flight, the caller waits for it to finish and
+// shares its result instead of starting a new RPC; if ctx is canceled first,
+// the caller is released without affecting the shared fetch. The caller that
+// triggers a new fetch runs it on a context detached from its own (like the
+// background path in Get), so that caller's ctx being canceled mid-RPC
+// doesn't cut the fetch short for every other caller sharing it; that caller
+// then waits for the result the same way the rest do.
+func (q *EventuallyConsistentQuotaUsage) fetchOrWait(
+	ctx context.Context) (cachedQuotaUsage, error) {
+	q.mu.Lock()
+	ch := q.fetchCh
+	if ch == nil {
+		ch = q.startFetchLocked()
+		q.mu.Unlock()
+		go func() {
+			fetchCtx, cancel := context.WithTimeout(
+				context.Background(), quotaFetchTimeout)
+			defer cancel()
+			_, _ = q.runFetch(fetchCtx, ch)
+		}()
+	} else {
+		q.mu.Unlock()
+	}
+
+	select {
+	case <-ch:
+		q.mu.RLock()
+		c, err := q.cached, q.fetchErr
+		q.mu.RUnlock()
+		if err != nil {
+			return cachedQuotaUsage{}, err
+		}
+		return c, nil
+	case <-ctx.Done():
+		return cachedQuotaUsage{}, ctx.Err()
+	}
+}
+
+func (q *EventuallyConsistentQuotaUsage) notifySubscribers(
+	usage cachedQuotaUsage) {
+	q.subscribersMu.Lock()
+	defer q.subscribersMu.Unlock()
+	update := QuotaUsage{
+		UsageBytes: usage.usageBytes,
+		LimitBytes: usage.limitBytes,
+	}
+	for _, ch := range q.subscribers {
+		select {
+		case ch <- update:
+		default:
+			q.log.Debug("Dropping quota usage update for a slow subscriber.")
+		}
+	}
+}
+
+// Subscribe registers ch to receive a QuotaUsage update every time the
+// cached quota usage is refreshed by Get, whether via a foreground or
+// background RPC. This lets long-lived consumers (e.g., the FS status
+// layer) get push updates instead of polling Get. ch should be buffered;
+// an update that can't be delivered immediately is dropped rather than
+// blocking the refresh.
+func (q *EventuallyConsistentQuotaUsage) Subscribe(ch chan<- QuotaUsage) {
+	q.subscribersMu.Lock()
+	defer q.subscribersMu.Unlock()
+	q.subscribers = append(q.subscribers, ch)
+}
+
 // Get returns KBFS bytes used and limit for user. To help avoid having too
 // frequent calls into bserver, caller can provide a positive tolerance, to
 // accept stale LimitBytes and UsageBytes data. If tolerance is 0 or negative,
@@ -90,6 +209,10 @@ func (q *EventuallyConsistentQuotaUsage) getAndCache(
 // 3) If the age of cached data is more than tolerance, a blocking RPC is
 // issued and the function only returns after RPC finishes, with the newest
 // data from RPC. The RPC causes cached data to be refreshed as well.
+//
+// In all cases, if a fetch is already in progress, it's shared rather than
+// triggering a duplicate RPC: a blocking caller waits on it, and case (2)
+// simply skips spawning another background fetch.
 func (q *EventuallyConsistentQuotaUsage) Get(ctx context.Context,
 	tolerance time.Duration) (usageBytes, limitBytes int64, err error) {
 	c := func() cachedQuotaUsage {
@@ -101,40 +224,44 @@ func (q *EventuallyConsistentQuotaUsage) Get(ctx context.Context,
 	switch {
 	case past > tolerance:
 		q.log.CDebugf(ctx, "Blocking on getAndCache. Cached data is %s old.", past)
-		// TODO: optimize this to make sure there's only one outstanding RPC. In
-		// other words, wait for it to finish if one is already in progress.
-		c, err = q.getAndCache(ctx)
+		c, err = q.fetchOrWait(ctx)
 		if err != nil {
 			return -1, -1, err
 		}
 	case past > tolerance/2:
-		if atomic.CompareAndSwapInt32(&q.backgroundInProcess, 0, 1) {
-			id, err := MakeRandomRequestID()
-			if err != nil {
-				q.log.Warning("Couldn't generate a random request ID: %v", err)
-			}
-			q.log.CDebugf(ctx, "Cached data is %s old. Spawning getAndCache in "+
-				"background with tag:%s=%v.", past, ECQUID, id)
-			go func() {
-				// Make a new context so that it doesn't get canceled when returned.
-				logTags := make(logger.CtxLogTags)
-				logTags[ECQUCtxTagKey{}] = ECQUID
-				bgCtx := logger.NewContextWithLogTags(context.Background(), logTags)
-				bgCtx = context.WithValue(bgCtx, ECQUCtxTagKey{}, id)
-				// Make sure a timeout is on the context, in case the RPC blocks
-				// forever somehow, where we'd end up with never resetting
-				// backgroundInProcess flag again.
-				bgCtx, cancel := context.WithTimeout(bgCtx, 10*time.Second)
-				defer cancel()
-				// The error is igonred here without logging since getAndCache already
-				// logs it.
-				_, _ = q.getAndCache(bgCtx)
-				atomic.StoreInt32(&q.backgroundInProcess, 0)
-			}()
-		} else {
+		q.mu.Lock()
+		var ch chan struct{}
+		alreadyFetching := q.fetchCh != nil
+		if !alreadyFetching {
+			ch = q.startFetchLocked()
+		}
+		q.mu.Unlock()
+		if alreadyFetching {
 			q.log.CDebugf(ctx,
 				"Cached data is %s old, but background getAndCache is already running.", past)
+			break
+		}
+		id, err := MakeRandomRequestID()
+		if err != nil {
+			q.log.Warning("Couldn't generate a random request ID: %v", err)
 		}
+		q.log.CDebugf(ctx, "Cached data is %s old. Spawning getAndCache in "+
+			"background with tag:%s=%v.", past, ECQUID, id)
+		go func() {
+			// Make a new context so that it doesn't get canceled when returned.
+			logTags := make(logger.CtxLogTags)
+			logTags[ECQUCtxTagKey{}] = ECQUID
+			bgCtx := logger.NewContextWithLogTags(context.Background(), logTags)
+			bgCtx = context.WithValue(bgCtx, ECQUCtxTagKey{}, id)
+			// Make sure a timeout is on the context, in case the RPC blocks
+			// forever somehow, where we'd end up never releasing fetchCh
+			// again.
+			bgCtx, cancel := context.WithTimeout(bgCtx, quotaFetchTimeout)
+			defer cancel()
+			// The error is igonred here without logging since getAndCache already
+			// logs it.
+			_, _ = q.runFetch(bgCtx, ch)
+		}()
 	default:
 		q.log.CDebugf(ctx, "Returning cached data from %s ago.", past)
 	}